@@ -2,15 +2,20 @@ package download
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/asn1"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	mrand "math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -55,6 +60,10 @@ type ATLeaf struct {
 	ExpiryMS        int64
 	ExtensionsSize  uint16
 	Extensions      []TransparencyExtension
+
+	// Raw holds the exact bytes this leaf was decoded from, so callers can
+	// recompute the RFC 6962 leaf hash without re-encoding the struct.
+	Raw []byte
 }
 
 type Ticket struct {
@@ -101,6 +110,21 @@ func (r PCCRelease) String() string {
 	return out
 }
 
+// readSizedBytes reads exactly n bytes from r, failing before allocating if
+// n claims more than r actually has left. This guards parseAtLeaf against a
+// hostile DescriptionSize/HashSize/extension Size allocating a buffer for
+// bytes the input does not hold before the short read is ever detected.
+func readSizedBytes(r *bytes.Reader, n int) ([]byte, error) {
+	if n < 0 || n > r.Len() {
+		return nil, fmt.Errorf("declared length %d exceeds %d remaining bytes", n, r.Len())
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func parseAtLeaf(r *bytes.Reader) (*ATLeaf, error) {
 	var leaf ATLeaf
 
@@ -113,15 +137,14 @@ func parseAtLeaf(r *bytes.Reader) (*ATLeaf, error) {
 	if err := binary.Read(r, binary.BigEndian, &leaf.DescriptionSize); err != nil {
 		return nil, fmt.Errorf("cannot read description size: %v", err)
 	}
-	leaf.Description = make([]byte, leaf.DescriptionSize)
-	if err := binary.Read(r, binary.BigEndian, &leaf.Description); err != nil {
+	var err error
+	if leaf.Description, err = readSizedBytes(r, int(leaf.DescriptionSize)); err != nil {
 		return nil, fmt.Errorf("cannot read description: %v", err)
 	}
 	if err := binary.Read(r, binary.BigEndian, &leaf.HashSize); err != nil {
 		return nil, fmt.Errorf("cannot read hash size: %v", err)
 	}
-	leaf.Hash = make([]byte, leaf.HashSize)
-	if err := binary.Read(r, binary.BigEndian, &leaf.Hash); err != nil {
+	if leaf.Hash, err = readSizedBytes(r, int(leaf.HashSize)); err != nil {
 		return nil, fmt.Errorf("cannot read hash: %v", err)
 	}
 	if err := binary.Read(r, binary.BigEndian, &leaf.ExpiryMS); err != nil {
@@ -138,8 +161,7 @@ func parseAtLeaf(r *bytes.Reader) (*ATLeaf, error) {
 		if err := binary.Read(r, binary.BigEndian, &ext.Size); err != nil {
 			return nil, fmt.Errorf("cannot read extension size: %v", err)
 		}
-		ext.Data = make([]byte, ext.Size)
-		if err := binary.Read(r, binary.BigEndian, &ext.Data); err != nil {
+		if ext.Data, err = readSizedBytes(r, int(ext.Size)); err != nil {
 			return nil, fmt.Errorf("cannot read extension data: %v", err)
 		}
 		leaf.Extensions = append(leaf.Extensions, ext)
@@ -147,72 +169,219 @@ func parseAtLeaf(r *bytes.Reader) (*ATLeaf, error) {
 	return &leaf, nil
 }
 
-func GetPCCReleases(proxy string) ([]PCCRelease, error) {
-	var releases []PCCRelease
+// MarshalBinary encodes l back into the wire format parseAtLeaf reads,
+// recomputing DescriptionSize/HashSize/ExtensionsSize and each extension's
+// Size from the corresponding slice lengths. It lets tests construct
+// synthetic leaves (and fuzz parseAtLeaf) without hand-building byte
+// buffers. It errors rather than silently truncating if a slice is too
+// long for the size field that must precede it on the wire.
+func (l *ATLeaf) MarshalBinary() ([]byte, error) {
+	if len(l.Description) > math.MaxUint8 {
+		return nil, fmt.Errorf("description length %d overflows uint8", len(l.Description))
+	}
+	if len(l.Hash) > math.MaxUint8 {
+		return nil, fmt.Errorf("hash length %d overflows uint8", len(l.Hash))
+	}
+	if len(l.Extensions) > math.MaxUint16 {
+		return nil, fmt.Errorf("extension count %d overflows uint16", len(l.Extensions))
+	}
+	for i, ext := range l.Extensions {
+		if len(ext.Data) > math.MaxUint16 {
+			return nil, fmt.Errorf("extension %d data length %d overflows uint16", i, len(ext.Data))
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err := binary.Write(&buf, binary.BigEndian, l.Version); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, l.Type); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, uint8(len(l.Description))); err != nil {
+		return nil, err
+	}
+	buf.Write(l.Description)
+	if err := binary.Write(&buf, binary.BigEndian, uint8(len(l.Hash))); err != nil {
+		return nil, err
+	}
+	buf.Write(l.Hash)
+	if err := binary.Write(&buf, binary.BigEndian, l.ExpiryMS); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, uint16(len(l.Extensions))); err != nil {
+		return nil, err
+	}
+	for _, ext := range l.Extensions {
+		if err := binary.Write(&buf, binary.BigEndian, ext.Type); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.BigEndian, uint16(len(ext.Data))); err != nil {
+			return nil, err
+		}
+		buf.Write(ext.Data)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// PCCOption configures GetPCCReleases.
+type PCCOption func(*pccConfig)
+
+// defaultLeavesPageSize is how many log leaves are requested per LogLeaves
+// RPC when none is configured via WithPageSize.
+const defaultLeavesPageSize = 256
+
+type pccConfig struct {
+	verify   bool
+	pageSize int
+	visit    func(PCCRelease) bool
+}
+
+// WithVerify makes GetPCCReleases check every release it returns against the
+// transparency log's inclusion proof for that leaf before handing it back.
+func WithVerify(verify bool) PCCOption {
+	return func(c *pccConfig) {
+		c.verify = verify
+	}
+}
+
+// WithPageSize overrides how many leaves are requested per LogLeaves RPC.
+func WithPageSize(n int) PCCOption {
+	return func(c *pccConfig) {
+		if n > 0 {
+			c.pageSize = n
+		}
+	}
+}
+
+// WithVisitor makes GetPCCReleases stream releases through visit as each
+// page of leaves is decoded instead of accumulating them into the returned
+// slice, which stays nil. This lets a caller bound memory on a full-log
+// fetch. visit follows the same convention as visitLogLeaves: returning
+// false stops the fetch early, without error.
+func WithVisitor(visit func(PCCRelease) bool) PCCOption {
+	return func(c *pccConfig) {
+		c.visit = visit
+	}
+}
+
+// httpStatusError records a non-2xx HTTP response so callers can decide
+// whether it is worth retrying.
+type httpStatusError struct {
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("returned status: %s", e.status)
+}
+
+func isRetryable(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// withRetry runs fn, retrying transient (5xx/network) failures with
+// exponential backoff and jitter, up to maxAttempts total tries.
+func withRetry(ctx context.Context, maxAttempts int, fn func() error) error {
+	var err error
+	backoff := 500 * time.Millisecond
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(); err == nil || !isRetryable(err) || attempt == maxAttempts {
+			return err
+		}
 
-	res, err := http.Get(bagURL)
+		wait := backoff + time.Duration(mrand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+func fetchBag(ctx context.Context) (BagResponse, error) {
+	var bag BagResponse
+
+	req, err := http.NewRequestWithContext(ctx, "GET", bagURL, nil)
+	if err != nil {
+		return bag, fmt.Errorf("cannot create http GET request: %v", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to GET bag: %v", err)
+		return bag, fmt.Errorf("failed to GET bag: %v", err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bag GET returned status: %s", res.Status)
+		return bag, &httpStatusError{status: res.Status, code: res.StatusCode}
 	}
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return bag, err
 	}
-	res.Body.Close()
 
 	os.WriteFile("bag.plist", body, 0644)
 
-	var bag BagResponse
 	if _, err := plist.Unmarshal(body, &bag); err != nil {
-		return nil, fmt.Errorf("cannot unmarshal plist: %v", err)
+		return bag, fmt.Errorf("cannot unmarshal plist: %v", err)
+	}
+
+	return bag, nil
+}
+
+func newPCCClient(proxy string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           GetProxy(proxy),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
 	}
+}
 
-	uuid := uuid.NewString()
+func fetchTree(ctx context.Context, client *http.Client, bag BagResponse) (*pcc.ListTreesResponse_Tree, error) {
+	id := uuid.NewString()
 
 	data, err := proto.Marshal(&pcc.ListTreesRequest{
 		Version:     pcc.ProtocolVersion_V3,
-		RequestUuid: uuid,
+		RequestUuid: id,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("cannot marshal ListTreesRequest: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", bag.AtResearcherListTrees, bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", bag.AtResearcherListTrees, bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("cannot create http POST request: %v", err)
 	}
-	req.Header.Set("X-Apple-Request-UUID", uuid)
+	req.Header.Set("X-Apple-Request-UUID", id)
 	req.Header.Set("Content-Type", "application/protobuf")
 	req.Header.Add("User-Agent", utils.RandomAgent())
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy:           GetProxy(proxy),
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-	}
-
-	res, err = client.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("returned status: %s", res.Status)
+		return nil, &httpStatusError{status: res.Status, code: res.StatusCode}
 	}
 
-	body, err = io.ReadAll(res.Body)
+	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
-	res.Body.Close()
 
 	var lt pcc.ListTreesResponse
 	if err := proto.Unmarshal(body, &lt); err != nil {
@@ -226,90 +395,105 @@ func GetPCCReleases(proxy string) ([]PCCRelease, error) {
 			tree = t
 		}
 	}
+	if tree == nil {
+		return nil, fmt.Errorf("no AT_LOG tree found for PRIVATE_CLOUD_COMPUTE")
+	}
+
+	return tree, nil
+}
 
-	data, err = proto.Marshal(&pcc.LogHeadRequest{
+func fetchLogHead(ctx context.Context, client *http.Client, bag BagResponse, treeID int64) (*pcc.LogHead, error) {
+	id := uuid.NewString()
+
+	data, err := proto.Marshal(&pcc.LogHeadRequest{
 		Version:     pcc.ProtocolVersion_V3,
-		TreeId:      tree.GetTreeId(),
+		TreeId:      treeID,
 		Revision:    -1,
-		RequestUuid: uuid,
+		RequestUuid: id,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("cannot marshal ListTreesRequest: %v", err)
+		return nil, fmt.Errorf("cannot marshal LogHeadRequest: %v", err)
 	}
 
-	req, err = http.NewRequest("POST", bag.AtResearcherLogHead, bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", bag.AtResearcherLogHead, bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("cannot create http POST request: %v", err)
 	}
-	req.Header.Set("X-Apple-Request-UUID", uuid)
+	req.Header.Set("X-Apple-Request-UUID", id)
 	req.Header.Set("Content-Type", "application/protobuf")
 	req.Header.Add("User-Agent", utils.RandomAgent())
 
-	res, err = client.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("returned status: %s", res.Status)
+		return nil, &httpStatusError{status: res.Status, code: res.StatusCode}
 	}
 
-	body, err = io.ReadAll(res.Body)
+	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
-	res.Body.Close()
 
 	var lh pcc.LogHeadResponse
 	if err := proto.Unmarshal(body, &lh); err != nil {
-		return nil, fmt.Errorf("cannot unmarshal ListTreesResponse: %v", err)
+		return nil, fmt.Errorf("cannot unmarshal LogHeadResponse: %v", err)
 	}
 	var logHead pcc.LogHead
 	if err := proto.Unmarshal(lh.GetLogHead().GetObject(), &logHead); err != nil {
 		return nil, fmt.Errorf("cannot unmarshal LogHead: %v", err)
 	}
 
-	data, err = proto.Marshal(&pcc.LogLeavesRequest{
+	return &logHead, nil
+}
+
+func fetchLogLeaves(ctx context.Context, client *http.Client, bag BagResponse, tree *pcc.ListTreesResponse_Tree, start, end uint64) ([]PCCRelease, error) {
+	var releases []PCCRelease
+
+	id := uuid.NewString()
+
+	data, err := proto.Marshal(&pcc.LogLeavesRequest{
 		Version:         pcc.ProtocolVersion_V3,
 		TreeId:          tree.GetTreeId(),
-		StartIndex:      0,
-		EndIndex:        logHead.GetLogSize(),
-		RequestUuid:     uuid,
+		StartIndex:      start,
+		EndIndex:        end,
+		RequestUuid:     id,
 		StartMergeGroup: 0,
 		EndMergeGroup:   uint32(tree.GetMergeGroups()),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("cannot marshal ListTreesRequest: %v", err)
+		return nil, fmt.Errorf("cannot marshal LogLeavesRequest: %v", err)
 	}
 
-	req, err = http.NewRequest("POST", bag.AtResearcherLogLeaves, bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", bag.AtResearcherLogLeaves, bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("cannot create http POST request: %v", err)
 	}
-	req.Header.Set("X-Apple-Request-UUID", uuid)
+	req.Header.Set("X-Apple-Request-UUID", id)
 	req.Header.Set("Content-Type", "application/protobuf")
 	req.Header.Add("User-Agent", utils.RandomAgent())
 
-	res, err = client.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("returned status: %s", res.Status)
+		return nil, &httpStatusError{status: res.Status, code: res.StatusCode}
 	}
 
-	body, err = io.ReadAll(res.Body)
+	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
-	res.Body.Close()
 
 	var lls pcc.LogLeavesResponse
 	if err := proto.Unmarshal(body, &lls); err != nil {
-		return nil, fmt.Errorf("cannot unmarshal ListTreesResponse: %v", err)
+		return nil, fmt.Errorf("cannot unmarshal LogLeavesResponse: %v", err)
 	}
 
 	for _, leave := range lls.GetLeaves() {
@@ -331,6 +515,7 @@ func GetPCCReleases(proxy string) ([]PCCRelease, error) {
 			if err != nil {
 				return nil, fmt.Errorf("cannot parse ATLeaf: %v", err)
 			}
+			release.ATLeaf.Raw = clnode.GetMutation()
 			if err := proto.Unmarshal(leave.GetMetadata(), &release.ReleaseMetadata); err != nil {
 				return nil, fmt.Errorf("cannot unmarshal ReleaseMetadata: %v", err)
 			}
@@ -343,3 +528,108 @@ func GetPCCReleases(proxy string) ([]PCCRelease, error) {
 
 	return releases, nil
 }
+
+// visitLogLeaves streams leaves from tree between [start, end) in pages of
+// pageSize, calling visit once per decoded release in log order. It stops
+// early, without error, the first time visit returns false, and respects
+// ctx cancellation between pages. Transient 5xx/network errors fetching a
+// page are retried with exponential backoff and jitter.
+func visitLogLeaves(ctx context.Context, client *http.Client, bag BagResponse, tree *pcc.ListTreesResponse_Tree, start, end uint64, pageSize int, visit func(PCCRelease) bool) error {
+	if pageSize <= 0 {
+		pageSize = defaultLeavesPageSize
+	}
+
+	for pageStart := start; pageStart < end; pageStart += uint64(pageSize) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		pageEnd := pageStart + uint64(pageSize)
+		if pageEnd > end {
+			pageEnd = end
+		}
+
+		var page []PCCRelease
+		err := withRetry(ctx, 5, func() error {
+			var err error
+			page, err = fetchLogLeaves(ctx, client, bag, tree, pageStart, pageEnd)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("cannot fetch leaves [%d,%d): %v", pageStart, pageEnd, err)
+		}
+
+		for _, release := range page {
+			if !visit(release) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetPCCReleases fetches every PCCRelease currently in Apple's PCC
+// transparency log, paging through LogLeaves in pageSize-sized (default
+// defaultLeavesPageSize) chunks so memory use and request size stay bounded
+// as the log grows. It respects ctx cancellation between pages. By default
+// it collects every release into the returned slice; pass WithVisitor to
+// stream them instead and keep memory use bounded on a full-log fetch.
+func GetPCCReleases(ctx context.Context, proxy string, opts ...PCCOption) ([]PCCRelease, error) {
+	var cfg pccConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	bag, err := fetchBag(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newPCCClient(proxy)
+
+	tree, err := fetchTree(ctx, client, bag)
+	if err != nil {
+		return nil, err
+	}
+
+	logHead, err := fetchLogHead(ctx, client, bag, tree.GetTreeId())
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []PCCRelease
+	visit := cfg.visit
+	if visit == nil {
+		visit = func(r PCCRelease) bool {
+			releases = append(releases, r)
+			return true
+		}
+	}
+
+	var verifyErr error
+	if cfg.verify {
+		if err := VerifyLogHead(ctx, bag, proxy, logHead); err != nil {
+			return nil, fmt.Errorf("log head failed transparency verification: %v", err)
+		}
+		next := visit
+		visit = func(r PCCRelease) bool {
+			if err := VerifyRelease(ctx, bag, proxy, tree.GetTreeId(), r, logHead); err != nil {
+				verifyErr = fmt.Errorf("release %d failed transparency verification: %v", r.Index, err)
+				return false
+			}
+			return next(r)
+		}
+	}
+
+	if err := visitLogLeaves(ctx, client, bag, tree, 0, logHead.GetLogSize(), cfg.pageSize, visit); err != nil {
+		return nil, err
+	}
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+
+	return releases, nil
+}
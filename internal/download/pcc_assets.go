@@ -0,0 +1,279 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/blacktop/ipsw/internal/download/pcc"
+	"github.com/blacktop/ipsw/internal/utils"
+)
+
+// AssetOption configures PCCRelease.DownloadAssets.
+type AssetOption func(*assetConfig)
+
+type assetConfig struct {
+	proxy              string
+	insecureSkipVerify bool
+	dryRun             bool
+	workers            int
+	types              map[pcc.AssetType]bool
+	variants           map[string]bool
+}
+
+func newAssetConfig() *assetConfig {
+	return &assetConfig{workers: 4}
+}
+
+// WithAssetProxy routes asset downloads through the given proxy URL.
+func WithAssetProxy(proxy string) AssetOption {
+	return func(c *assetConfig) { c.proxy = proxy }
+}
+
+// WithAssetInsecureSkipVerify disables TLS certificate verification for
+// asset downloads.
+func WithAssetInsecureSkipVerify(insecure bool) AssetOption {
+	return func(c *assetConfig) { c.insecureSkipVerify = insecure }
+}
+
+// WithAssetDryRun makes DownloadAssets print the resolved URL/digest table
+// for every matching asset instead of fetching it.
+func WithAssetDryRun(dryRun bool) AssetOption {
+	return func(c *assetConfig) { c.dryRun = dryRun }
+}
+
+// WithAssetWorkers sets how many assets are downloaded in parallel. Default 4.
+func WithAssetWorkers(n int) AssetOption {
+	return func(c *assetConfig) {
+		if n > 0 {
+			c.workers = n
+		}
+	}
+}
+
+// WithAssetTypes restricts DownloadAssets to the given asset types.
+func WithAssetTypes(types ...pcc.AssetType) AssetOption {
+	return func(c *assetConfig) {
+		if c.types == nil {
+			c.types = make(map[pcc.AssetType]bool)
+		}
+		for _, t := range types {
+			c.types[t] = true
+		}
+	}
+}
+
+// WithAssetVariants restricts DownloadAssets to the given asset variants.
+func WithAssetVariants(variants ...string) AssetOption {
+	return func(c *assetConfig) {
+		if c.variants == nil {
+			c.variants = make(map[string]bool)
+		}
+		for _, v := range variants {
+			c.variants[v] = true
+		}
+	}
+}
+
+func (c *assetConfig) matches(asset *pcc.ReleaseMetadata_Asset) bool {
+	if c.types != nil && !c.types[asset.GetType()] {
+		return false
+	}
+	if c.variants != nil && !c.variants[asset.GetVariant()] {
+		return false
+	}
+	return true
+}
+
+func newAssetHasher(alg pcc.DigestAlg) (hash.Hash, error) {
+	switch alg {
+	case pcc.DigestAlg_SHA256:
+		return sha256.New(), nil
+	case pcc.DigestAlg_SHA384:
+		return sha512.New384(), nil
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm: %s", alg)
+	}
+}
+
+func assetFileName(index int, asset *pcc.ReleaseMetadata_Asset) string {
+	var ext string
+	if u, err := url.Parse(asset.GetUrl()); err == nil {
+		ext = path.Ext(u.Path)
+	}
+	if ext == "" {
+		ext = ".bin"
+	}
+	return fmt.Sprintf("%d_%s%s", index, asset.GetVariant(), ext)
+}
+
+// downloadAssetResumable fetches url into dst, resuming from dst's current
+// size via a Range request if it already exists, and returns the digest of
+// the full file's contents computed with the given hash algorithm.
+func downloadAssetResumable(ctx context.Context, client *http.Client, url, dst string, alg pcc.DigestAlg) ([]byte, error) {
+	hasher, err := newAssetHasher(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	var resumeFrom int64
+	if fi, err := os.Stat(dst); err == nil {
+		resumeFrom = fi.Size()
+	}
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %v", dst, err)
+	}
+	defer f.Close()
+
+	if resumeFrom > 0 {
+		if _, err := f.Seek(resumeFrom, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("cannot seek %s: %v", dst, err)
+		}
+		if _, err := io.CopyN(hasher, io.NewSectionReader(f, 0, resumeFrom), resumeFrom); err != nil {
+			return nil, fmt.Errorf("cannot hash existing bytes of %s: %v", dst, err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create http GET request: %v", err)
+	}
+	req.Header.Add("User-Agent", utils.RandomAgent())
+	if resumeFrom > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// dst is already fully downloaded: the server has nothing left to
+		// send for our "bytes=resumeFrom-" request.
+		return hasher.Sum(nil), nil
+	default:
+		return nil, fmt.Errorf("returned status: %s", res.Status)
+	}
+	if resumeFrom > 0 && res.StatusCode == http.StatusOK {
+		// server ignored our Range request; start over from scratch
+		hasher, err = newAssetHasher(alg)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Truncate(0); err != nil {
+			return nil, fmt.Errorf("cannot truncate %s: %v", dst, err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("cannot seek %s: %v", dst, err)
+		}
+	}
+
+	if _, err := io.Copy(io.MultiWriter(f, hasher), res.Body); err != nil {
+		return nil, fmt.Errorf("cannot write %s: %v", dst, err)
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// DownloadAssets fetches every asset attached to r's ReleaseMetadata into
+// dir, verifying each one against the digest advertised by the log. A
+// digest mismatch is a hard error since it means the downloaded bytes do
+// not match what Apple committed to in the transparency log.
+func (r PCCRelease) DownloadAssets(ctx context.Context, dir string, opts ...AssetOption) error {
+	cfg := newAssetConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	assets := r.GetAssets()
+
+	type job struct {
+		index int
+		asset *pcc.ReleaseMetadata_Asset
+	}
+	var jobs []job
+	for i, asset := range assets {
+		if !cfg.matches(asset) {
+			continue
+		}
+		jobs = append(jobs, job{index: i, asset: asset})
+	}
+
+	if cfg.dryRun {
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].index < jobs[j].index })
+		for _, j := range jobs {
+			fmt.Printf("%-24s %-10s (%s) %-64s %s\n",
+				assetFileName(j.index, j.asset),
+				j.asset.GetType().String(),
+				j.asset.Digest.GetDigestAlg().String(),
+				hex.EncodeToString(j.asset.Digest.GetValue()),
+				j.asset.GetUrl())
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create %s: %v", dir, err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           GetProxy(cfg.proxy),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.insecureSkipVerify},
+		},
+	}
+
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, cfg.workers)
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+
+	for _, j := range jobs {
+		j := j
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			dst := filepath.Join(dir, assetFileName(j.index, j.asset))
+			digest, err := downloadAssetResumable(ctx, client, j.asset.GetUrl(), dst, j.asset.Digest.GetDigestAlg())
+			if err != nil {
+				fail(fmt.Errorf("cannot download asset %d (%s): %v", j.index, j.asset.GetVariant(), err))
+				return
+			}
+			if !bytes.Equal(digest, j.asset.Digest.GetValue()) {
+				fail(fmt.Errorf("asset %d (%s) digest mismatch: got %s, want %s",
+					j.index, j.asset.GetVariant(), hex.EncodeToString(digest), hex.EncodeToString(j.asset.Digest.GetValue())))
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,117 @@
+package download
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Known TransparencyExtension.Type values. Unrecognised types decode to
+// *UnknownExtension so round-tripping never loses data.
+const (
+	ExtensionTypeSignedTimestamp uint32 = 0x01 // SCT-like signed log timestamp
+	ExtensionTypeHashAlgorithm   uint32 = 0x02 // hash algorithm identifier for Hash
+	ExtensionTypePreviousLeaf    uint32 = 0x03 // back-pointer to a prior leaf index
+	ExtensionTypeAppTag          uint32 = 0x04 // opaque per-application tag
+)
+
+// ExtensionValue is the common interface implemented by every decoded
+// TransparencyExtension variant, including *UnknownExtension.
+type ExtensionValue interface {
+	ExtensionType() uint32
+}
+
+// SignedTimestampExtension is an SCT-like proof that the log observed this
+// leaf no later than TimestampMS.
+type SignedTimestampExtension struct {
+	TimestampMS int64
+	Signature   []byte
+}
+
+func (e *SignedTimestampExtension) ExtensionType() uint32 { return ExtensionTypeSignedTimestamp }
+
+// HashAlgorithmExtension identifies the algorithm used to produce ATLeaf.Hash.
+type HashAlgorithmExtension struct {
+	Algorithm uint8
+}
+
+func (e *HashAlgorithmExtension) ExtensionType() uint32 { return ExtensionTypeHashAlgorithm }
+
+// PreviousLeafExtension points back at the log index of the leaf this one
+// supersedes or follows.
+type PreviousLeafExtension struct {
+	Index uint64
+}
+
+func (e *PreviousLeafExtension) ExtensionType() uint32 { return ExtensionTypePreviousLeaf }
+
+// AppTagExtension carries an opaque, application-defined string tag.
+type AppTagExtension struct {
+	Tag string
+}
+
+func (e *AppTagExtension) ExtensionType() uint32 { return ExtensionTypeAppTag }
+
+// UnknownExtension preserves the raw bytes of a TransparencyExtension whose
+// Type isn't one of the known ExtensionType* constants.
+type UnknownExtension struct {
+	Type uint32
+	Data []byte
+}
+
+func (e *UnknownExtension) ExtensionType() uint32 { return e.Type }
+
+// decodeExtension turns a single raw TransparencyExtension into its typed
+// representation, falling back to *UnknownExtension for types it doesn't
+// recognise or can't parse cleanly.
+func decodeExtension(ext TransparencyExtension) ExtensionValue {
+	r := bytes.NewReader(ext.Data)
+
+	switch ext.Type {
+	case ExtensionTypeSignedTimestamp:
+		var ts int64
+		if err := binary.Read(r, binary.BigEndian, &ts); err != nil {
+			break
+		}
+		sig := make([]byte, r.Len())
+		if _, err := io.ReadFull(r, sig); err != nil {
+			break
+		}
+		return &SignedTimestampExtension{TimestampMS: ts, Signature: sig}
+
+	case ExtensionTypeHashAlgorithm:
+		if r.Len() != 1 {
+			break
+		}
+		alg, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		return &HashAlgorithmExtension{Algorithm: alg}
+
+	case ExtensionTypePreviousLeaf:
+		var idx uint64
+		if err := binary.Read(r, binary.BigEndian, &idx); err != nil || r.Len() != 0 {
+			break
+		}
+		return &PreviousLeafExtension{Index: idx}
+
+	case ExtensionTypeAppTag:
+		return &AppTagExtension{Tag: string(ext.Data)}
+	}
+
+	return &UnknownExtension{Type: ext.Type, Data: ext.Data}
+}
+
+// TypedExtensions decodes l's raw Extensions into a discriminated union of
+// concrete Go types, one per recognised TransparencyExtension.Type. Entries
+// whose Type isn't recognised, or whose Data doesn't parse as its expected
+// shape, come back as *UnknownExtension with Data untouched so callers can
+// still inspect or re-encode them.
+func (l *ATLeaf) TypedExtensions() []ExtensionValue {
+	out := make([]ExtensionValue, len(l.Extensions))
+	for i, ext := range l.Extensions {
+		out[i] = decodeExtension(ext)
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+package download
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeExtensionKnownTypes(t *testing.T) {
+	var signedTimestampData bytes.Buffer
+	binary.Write(&signedTimestampData, binary.BigEndian, int64(1717000000000))
+	signedTimestampData.Write([]byte{0xDE, 0xAD, 0xBE, 0xEF})
+
+	var previousLeafData bytes.Buffer
+	binary.Write(&previousLeafData, binary.BigEndian, uint64(42))
+
+	tests := []struct {
+		name string
+		ext  TransparencyExtension
+		want ExtensionValue
+	}{
+		{
+			name: "signed timestamp",
+			ext:  TransparencyExtension{Type: ExtensionTypeSignedTimestamp, Data: signedTimestampData.Bytes()},
+			want: &SignedTimestampExtension{TimestampMS: 1717000000000, Signature: []byte{0xDE, 0xAD, 0xBE, 0xEF}},
+		},
+		{
+			name: "hash algorithm",
+			ext:  TransparencyExtension{Type: ExtensionTypeHashAlgorithm, Data: []byte{0x02}},
+			want: &HashAlgorithmExtension{Algorithm: 0x02},
+		},
+		{
+			name: "previous leaf",
+			ext:  TransparencyExtension{Type: ExtensionTypePreviousLeaf, Data: previousLeafData.Bytes()},
+			want: &PreviousLeafExtension{Index: 42},
+		},
+		{
+			name: "app tag",
+			ext:  TransparencyExtension{Type: ExtensionTypeAppTag, Data: []byte("com.apple.foo")},
+			want: &AppTagExtension{Tag: "com.apple.foo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeExtension(tt.ext)
+			if !extensionsEqual(got, tt.want) {
+				t.Fatalf("decodeExtension() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeExtensionFallsBackToUnknown(t *testing.T) {
+	tests := []struct {
+		name string
+		ext  TransparencyExtension
+	}{
+		{
+			name: "unrecognised type",
+			ext:  TransparencyExtension{Type: 0xFF, Data: []byte{0x01, 0x02, 0x03}},
+		},
+		{
+			name: "hash algorithm with wrong length",
+			ext:  TransparencyExtension{Type: ExtensionTypeHashAlgorithm, Data: []byte{0x01, 0x02}},
+		},
+		{
+			name: "previous leaf with trailing bytes",
+			ext:  TransparencyExtension{Type: ExtensionTypePreviousLeaf, Data: append(make([]byte, 8), 0xFF)},
+		},
+		{
+			name: "signed timestamp too short for its int64",
+			ext:  TransparencyExtension{Type: ExtensionTypeSignedTimestamp, Data: []byte{0x01, 0x02, 0x03}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeExtension(tt.ext)
+			unknown, ok := got.(*UnknownExtension)
+			if !ok {
+				t.Fatalf("decodeExtension() = %#v (%T), want *UnknownExtension", got, got)
+			}
+			if unknown.Type != tt.ext.Type || !bytes.Equal(unknown.Data, tt.ext.Data) {
+				t.Fatalf("decodeExtension() = %#v, want {Type: %d, Data: %x}", unknown, tt.ext.Type, tt.ext.Data)
+			}
+		})
+	}
+}
+
+func TestATLeafTypedExtensions(t *testing.T) {
+	leaf := &ATLeaf{
+		Extensions: []TransparencyExtension{
+			{Type: ExtensionTypeHashAlgorithm, Data: []byte{0x01}},
+			{Type: ExtensionTypeAppTag, Data: []byte("tag")},
+			{Type: 0x99, Data: []byte{0xAA}},
+		},
+	}
+
+	got := leaf.TypedExtensions()
+	if len(got) != len(leaf.Extensions) {
+		t.Fatalf("TypedExtensions() returned %d values, want %d", len(got), len(leaf.Extensions))
+	}
+	if !extensionsEqual(got[0], &HashAlgorithmExtension{Algorithm: 0x01}) {
+		t.Errorf("got[0] = %#v", got[0])
+	}
+	if !extensionsEqual(got[1], &AppTagExtension{Tag: "tag"}) {
+		t.Errorf("got[1] = %#v", got[1])
+	}
+	if !extensionsEqual(got[2], &UnknownExtension{Type: 0x99, Data: []byte{0xAA}}) {
+		t.Errorf("got[2] = %#v", got[2])
+	}
+}
+
+func extensionsEqual(a, b ExtensionValue) bool {
+	switch av := a.(type) {
+	case *SignedTimestampExtension:
+		bv, ok := b.(*SignedTimestampExtension)
+		return ok && av.TimestampMS == bv.TimestampMS && bytes.Equal(av.Signature, bv.Signature)
+	case *HashAlgorithmExtension:
+		bv, ok := b.(*HashAlgorithmExtension)
+		return ok && av.Algorithm == bv.Algorithm
+	case *PreviousLeafExtension:
+		bv, ok := b.(*PreviousLeafExtension)
+		return ok && av.Index == bv.Index
+	case *AppTagExtension:
+		bv, ok := b.(*AppTagExtension)
+		return ok && av.Tag == bv.Tag
+	case *UnknownExtension:
+		bv, ok := b.(*UnknownExtension)
+		return ok && av.Type == bv.Type && bytes.Equal(av.Data, bv.Data)
+	default:
+		return false
+	}
+}
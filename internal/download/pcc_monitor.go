@@ -0,0 +1,211 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blacktop/ipsw/internal/download/pcc"
+)
+
+// pccTrustedHead is the on-disk representation of the last LogHead a
+// PCCMonitor has successfully verified.
+type pccTrustedHead struct {
+	TreeID    int64     `json:"tree_id"`
+	LogSize   uint64    `json:"log_size"`
+	RootHash  []byte    `json:"root_hash"`
+	KeyID     []byte    `json:"key_id"`
+	Algorithm string    `json:"algorithm"`
+	Signature []byte    `json:"signature"`
+	SavedAt   time.Time `json:"saved_at"`
+}
+
+func (h *pccTrustedHead) toLogHead() *pcc.LogHead {
+	return &pcc.LogHead{
+		LogSize:  h.LogSize,
+		RootHash: h.RootHash,
+		Signature: &pcc.Signature{
+			KeyId:     h.KeyID,
+			Algorithm: pcc.SignatureAlgorithm(pcc.SignatureAlgorithm_value[h.Algorithm]),
+			Signature: h.Signature,
+		},
+	}
+}
+
+func pccTrustedHeadFrom(treeID int64, head *pcc.LogHead) *pccTrustedHead {
+	return &pccTrustedHead{
+		TreeID:    treeID,
+		LogSize:   head.GetLogSize(),
+		RootHash:  head.GetRootHash(),
+		KeyID:     head.GetSignature().GetKeyId(),
+		Algorithm: head.GetSignature().GetAlgorithm().String(),
+		Signature: head.GetSignature().GetSignature(),
+		SavedAt:   time.Now(),
+	}
+}
+
+// PCCMonitor watches Apple's PCC transparency log for newly appended
+// releases, persisting the last verified LogHead to disk so restarts pick up
+// where they left off instead of re-verifying the whole log.
+type PCCMonitor struct {
+	Proxy string
+	// StatePath is where the trusted LogHead is persisted. Defaults to
+	// ~/.ipsw/pcc/state.json.
+	StatePath string
+
+	// OnNewRelease is called once per newly appended release discovered by
+	// Poll/Watch, in log order.
+	OnNewRelease func(PCCRelease)
+	// OnSplitView is called when the log presents a consistency proof that
+	// does not extend the previously trusted head, i.e. Apple's log has
+	// forked relative to what this client last saw.
+	OnSplitView func(trusted, presented *pcc.LogHead, err error)
+}
+
+// NewPCCMonitor returns a PCCMonitor with its state file defaulted to
+// ~/.ipsw/pcc/state.json.
+func NewPCCMonitor(proxy string) (*PCCMonitor, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine home directory: %v", err)
+	}
+
+	return &PCCMonitor{
+		Proxy:     proxy,
+		StatePath: filepath.Join(home, ".ipsw", "pcc", "state.json"),
+	}, nil
+}
+
+func (m *PCCMonitor) loadTrustedHead() (*pccTrustedHead, error) {
+	dat, err := os.ReadFile(m.StatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read %s: %v", m.StatePath, err)
+	}
+
+	var h pccTrustedHead
+	if err := json.Unmarshal(dat, &h); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal %s: %v", m.StatePath, err)
+	}
+
+	return &h, nil
+}
+
+func (m *PCCMonitor) saveTrustedHead(h *pccTrustedHead) error {
+	if err := os.MkdirAll(filepath.Dir(m.StatePath), 0755); err != nil {
+		return fmt.Errorf("cannot create %s: %v", filepath.Dir(m.StatePath), err)
+	}
+
+	dat, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal trusted head: %v", err)
+	}
+
+	return os.WriteFile(m.StatePath, dat, 0644)
+}
+
+// Poll fetches the current LogHead, verifies it is a consistent extension of
+// whatever was last persisted to StatePath (skipping that check on a fresh
+// state file), and returns any releases appended since then. OnNewRelease is
+// invoked for all of them before the new head is persisted, so a crash
+// between delivery and the write is re-observed on the next Poll instead of
+// silently skipping releases that already fell before startIndex.
+func (m *PCCMonitor) Poll(ctx context.Context) ([]PCCRelease, error) {
+	bag, err := fetchBag(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newPCCClient(m.Proxy)
+
+	tree, err := fetchTree(ctx, client, bag)
+	if err != nil {
+		return nil, err
+	}
+
+	newHead, err := fetchLogHead(ctx, client, bag, tree.GetTreeId())
+	if err != nil {
+		return nil, err
+	}
+
+	trusted, err := m.loadTrustedHead()
+	if err != nil {
+		return nil, err
+	}
+
+	var startIndex uint64
+	if trusted != nil {
+		oldHead := trusted.toLogHead()
+		if err := VerifyConsistency(ctx, bag, m.Proxy, tree.GetTreeId(), oldHead, newHead); err != nil {
+			if m.OnSplitView != nil {
+				m.OnSplitView(oldHead, newHead, err)
+			}
+			return nil, fmt.Errorf("PCC log failed consistency check against trusted head: %v", err)
+		}
+		startIndex = trusted.LogSize
+	}
+
+	if newHead.GetLogSize() == startIndex {
+		return nil, nil
+	}
+
+	var releases []PCCRelease
+	err = visitLogLeaves(ctx, client, bag, tree, startIndex, newHead.GetLogSize(), defaultLeavesPageSize, func(r PCCRelease) bool {
+		releases = append(releases, r)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(releases) > 0 {
+		if err := VerifyLogHead(ctx, bag, m.Proxy, newHead); err != nil {
+			return nil, fmt.Errorf("log head failed transparency verification: %v", err)
+		}
+		for _, release := range releases {
+			if err := VerifyRelease(ctx, bag, m.Proxy, tree.GetTreeId(), release, newHead); err != nil {
+				return nil, fmt.Errorf("release %d failed transparency verification: %v", release.Index, err)
+			}
+		}
+	}
+
+	for _, release := range releases {
+		if m.OnNewRelease != nil {
+			m.OnNewRelease(release)
+		}
+	}
+
+	if err := m.saveTrustedHead(pccTrustedHeadFrom(tree.GetTreeId(), newHead)); err != nil {
+		return nil, err
+	}
+
+	return releases, nil
+}
+
+// Watch calls Poll on the given interval until ctx is cancelled, delivering
+// newly appended releases to OnNewRelease as they are discovered. It returns
+// the first error any Poll reports, including a failed consistency check.
+func (m *PCCMonitor) Watch(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if _, err := m.Poll(ctx); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := m.Poll(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/blacktop/ipsw/internal/download/pcc"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+// RFC 6962 domain-separation prefixes for Merkle tree hashing.
+const (
+	rfc6962LeafPrefix = 0x00
+	rfc6962NodePrefix = 0x01
+)
+
+func leafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{rfc6962LeafPrefix})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{rfc6962NodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// verifyInclusion recomputes the Merkle root from a leaf hash, its index and
+// the sibling hashes returned by the log, following the RFC 6962 algorithm.
+func verifyInclusion(leafH []byte, index, size uint64, proof [][]byte) ([]byte, error) {
+	if index >= size {
+		return nil, fmt.Errorf("leaf index %d out of range for tree size %d", index, size)
+	}
+
+	fn, sn := index, size-1
+	root := leafH
+	for len(proof) > 0 {
+		p := proof[0]
+		proof = proof[1:]
+		if fn&1 == 1 || fn == sn {
+			root = nodeHash(p, root)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			root = nodeHash(root, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return nil, fmt.Errorf("inclusion proof too short: %d nodes left unconsumed", sn)
+	}
+	return root, nil
+}
+
+// verifyConsistencyProof checks that a tree of size `second` with root
+// `secondRoot` is an append-only extension of a tree of size `first` with
+// root `firstRoot`, per the RFC 6962 consistency-proof algorithm.
+func verifyConsistencyProof(first, second uint64, firstRoot, secondRoot []byte, proof [][]byte) error {
+	if first == 0 {
+		return nil // an empty tree is consistent with anything
+	}
+	if first == second {
+		if len(proof) != 0 {
+			return fmt.Errorf("expected empty consistency proof for equal tree sizes")
+		}
+		if !bytes.Equal(firstRoot, secondRoot) {
+			return fmt.Errorf("root mismatch for equal tree sizes")
+		}
+		return nil
+	}
+	if first > second {
+		return fmt.Errorf("first tree size %d larger than second %d", first, second)
+	}
+
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	var oldHash, newHash []byte
+	if fn > 0 {
+		if len(proof) == 0 {
+			return fmt.Errorf("empty consistency proof")
+		}
+		oldHash, newHash = proof[0], proof[0]
+		proof = proof[1:]
+	} else {
+		oldHash, newHash = firstRoot, firstRoot
+	}
+
+	for _, h := range proof {
+		if sn == 0 {
+			return fmt.Errorf("consistency proof has more hashes than expected")
+		}
+		if fn&1 == 1 || fn == sn {
+			oldHash = nodeHash(h, oldHash)
+			newHash = nodeHash(h, newHash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			newHash = nodeHash(newHash, h)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if !bytes.Equal(oldHash, firstRoot) {
+		return fmt.Errorf("recomputed old root does not match trusted head")
+	}
+	if !bytes.Equal(newHash, secondRoot) {
+		return fmt.Errorf("recomputed new root does not match new head")
+	}
+	return nil
+}
+
+func verifyLogHeadSignature(head *pcc.LogHead, keys []*pcc.PublicKey) error {
+	sig := head.GetSignature()
+	if sig == nil {
+		return fmt.Errorf("log head has no signature")
+	}
+
+	var key *pcc.PublicKey
+	for _, k := range keys {
+		if bytes.Equal(k.GetKeyId(), sig.GetKeyId()) {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("no public key found for key id %x", sig.GetKeyId())
+	}
+
+	signed, err := proto.Marshal(&pcc.SignedLogHead{
+		LogSize:  head.GetLogSize(),
+		RootHash: head.GetRootHash(),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal signed portion of log head: %v", err)
+	}
+
+	switch key.GetAlgorithm() {
+	case pcc.SignatureAlgorithm_ED25519:
+		if !ed25519.Verify(ed25519.PublicKey(key.GetPublicKey()), signed, sig.GetSignature()) {
+			return fmt.Errorf("ed25519 signature verification failed")
+		}
+	case pcc.SignatureAlgorithm_ECDSA_P256_SHA256:
+		pub, err := x509.ParsePKIXPublicKey(key.GetPublicKey())
+		if err != nil {
+			return fmt.Errorf("cannot parse ecdsa public key: %v", err)
+		}
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("public key is not ECDSA")
+		}
+		digest := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(ecPub, digest[:], sig.GetSignature()) {
+			return fmt.Errorf("ecdsa signature verification failed")
+		}
+	default:
+		return fmt.Errorf("unsupported signature algorithm: %s", key.GetAlgorithm())
+	}
+
+	return nil
+}
+
+func fetchPublicKeys(ctx context.Context, client *http.Client, url string) ([]*pcc.PublicKey, error) {
+	id := uuid.NewString()
+	data, err := proto.Marshal(&pcc.PublicKeysRequest{
+		Version:     pcc.ProtocolVersion_V3,
+		RequestUuid: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal PublicKeysRequest: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create http POST request: %v", err)
+	}
+	req.Header.Set("X-Apple-Request-UUID", id)
+	req.Header.Set("Content-Type", "application/protobuf")
+	req.Header.Add("User-Agent", utils.RandomAgent())
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{status: res.Status, code: res.StatusCode}
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var pk pcc.PublicKeysResponse
+	if err := proto.Unmarshal(body, &pk); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal PublicKeysResponse: %v", err)
+	}
+
+	return pk.GetKeys(), nil
+}
+
+func fetchInclusionProof(ctx context.Context, client *http.Client, url string, treeID int64, index, size uint64) (*pcc.InclusionProof, error) {
+	id := uuid.NewString()
+	data, err := proto.Marshal(&pcc.LogInclusionProofRequest{
+		Version:     pcc.ProtocolVersion_V3,
+		TreeId:      treeID,
+		LeafIndex:   index,
+		TreeSize:    size,
+		RequestUuid: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal LogInclusionProofRequest: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create http POST request: %v", err)
+	}
+	req.Header.Set("X-Apple-Request-UUID", id)
+	req.Header.Set("Content-Type", "application/protobuf")
+	req.Header.Add("User-Agent", utils.RandomAgent())
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{status: res.Status, code: res.StatusCode}
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var ip pcc.LogInclusionProofResponse
+	if err := proto.Unmarshal(body, &ip); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal LogInclusionProofResponse: %v", err)
+	}
+
+	return ip.GetProof(), nil
+}
+
+func fetchConsistencyProof(ctx context.Context, client *http.Client, url string, treeID int64, first, second uint64) (*pcc.ConsistencyProof, error) {
+	id := uuid.NewString()
+	data, err := proto.Marshal(&pcc.ConsistencyProofRequest{
+		Version:     pcc.ProtocolVersion_V3,
+		TreeId:      treeID,
+		FirstSize:   first,
+		SecondSize:  second,
+		RequestUuid: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal ConsistencyProofRequest: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create http POST request: %v", err)
+	}
+	req.Header.Set("X-Apple-Request-UUID", id)
+	req.Header.Set("Content-Type", "application/protobuf")
+	req.Header.Add("User-Agent", utils.RandomAgent())
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{status: res.Status, code: res.StatusCode}
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var cp pcc.ConsistencyProofResponse
+	if err := proto.Unmarshal(body, &cp); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal ConsistencyProofResponse: %v", err)
+	}
+
+	return cp.GetProof(), nil
+}
+
+// VerifyLogHead checks head's signature against the keys published by the
+// at-researcher-public-keys endpoint. Callers verifying a batch of releases
+// against the same head (GetPCCReleases, PCCMonitor.Poll) should call this
+// once per head rather than paying for a key fetch and signature check on
+// every release via VerifyRelease. ctx cancels the underlying request and
+// governs the retry of transient (5xx/network) failures.
+func VerifyLogHead(ctx context.Context, bag BagResponse, proxy string, head *pcc.LogHead) error {
+	client := newPCCClient(proxy)
+
+	var keys []*pcc.PublicKey
+	err := withRetry(ctx, 5, func() error {
+		var err error
+		keys, err = fetchPublicKeys(ctx, client, bag.AtResearcherPublicKeys)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot fetch public keys: %v", err)
+	}
+	if err := verifyLogHeadSignature(head, keys); err != nil {
+		return fmt.Errorf("log head signature invalid: %v", err)
+	}
+
+	return nil
+}
+
+// VerifyRelease checks that r's underlying ATLeaf is included in the tree
+// described by head: it recomputes the leaf hash, fetches an inclusion
+// proof from Apple's transparency log and walks it up to head's root hash.
+// Callers must verify head's signature themselves (via VerifyLogHead) before
+// or after calling this; VerifyRelease does not repeat that check, so it can
+// be called once per release against a head that was already verified once.
+// ctx cancels the underlying requests and governs the retry of transient
+// (5xx/network) failures.
+func VerifyRelease(ctx context.Context, bag BagResponse, proxy string, treeID int64, r PCCRelease, head *pcc.LogHead) error {
+	client := newPCCClient(proxy)
+
+	var proof *pcc.InclusionProof
+	err := withRetry(ctx, 5, func() error {
+		var err error
+		proof, err = fetchInclusionProof(ctx, client, bag.AtResearcherLogInclusionProof, treeID, r.Index, head.GetLogSize())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot fetch inclusion proof for leaf %d: %v", r.Index, err)
+	}
+
+	if len(r.ATLeaf.Raw) == 0 {
+		return fmt.Errorf("release %d has no raw leaf bytes to hash", r.Index)
+	}
+
+	root, err := verifyInclusion(leafHash(r.ATLeaf.Raw), r.Index, head.GetLogSize(), proof.GetHashes())
+	if err != nil {
+		return fmt.Errorf("cannot verify inclusion of leaf %d: %v", r.Index, err)
+	}
+	if !bytes.Equal(root, head.GetRootHash()) {
+		return fmt.Errorf("inclusion proof for leaf %d does not chain to the trusted log head", r.Index)
+	}
+
+	return nil
+}
+
+// VerifyConsistency proves that new is an append-only extension of old by
+// fetching a consistency proof from Apple's transparency log and checking
+// that both the old and new root hashes are reproduced from it. Callers
+// should treat a failure here as evidence of a split view / forked log. ctx
+// cancels the underlying request and governs the retry of transient
+// (5xx/network) failures.
+func VerifyConsistency(ctx context.Context, bag BagResponse, proxy string, treeID int64, old, new *pcc.LogHead) error {
+	if old.GetLogSize() > new.GetLogSize() {
+		return fmt.Errorf("trusted head (size %d) is ahead of new head (size %d)", old.GetLogSize(), new.GetLogSize())
+	}
+
+	client := newPCCClient(proxy)
+
+	var proof *pcc.ConsistencyProof
+	err := withRetry(ctx, 5, func() error {
+		var err error
+		proof, err = fetchConsistencyProof(ctx, client, bag.AtResearcherConsistencyProof, treeID, old.GetLogSize(), new.GetLogSize())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot fetch consistency proof: %v", err)
+	}
+
+	if err := verifyConsistencyProof(old.GetLogSize(), new.GetLogSize(), old.GetRootHash(), new.GetRootHash(), proof.GetHashes()); err != nil {
+		return fmt.Errorf("consistency proof failed: %v", err)
+	}
+
+	return nil
+}
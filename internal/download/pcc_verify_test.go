@@ -0,0 +1,85 @@
+package download
+
+import (
+	"bytes"
+	"testing"
+)
+
+// mth computes the RFC 6962 Merkle Tree Hash of leaves, independently of
+// verifyConsistencyProof, so it can be used as a reference oracle in tests.
+func mth(leaves [][]byte) []byte {
+	n := len(leaves)
+	if n == 1 {
+		return leafHash(leaves[0])
+	}
+	k := largestPowerOfTwoLessThan(n)
+	return nodeHash(mth(leaves[:k]), mth(leaves[k:]))
+}
+
+func largestPowerOfTwoLessThan(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// subproof implements the RFC 6962 SUBPROOF recursion, independently of
+// verifyConsistencyProof, to generate reference consistency proofs.
+func subproof(m int, d [][]byte, b bool) [][]byte {
+	n := len(d)
+	if m == n {
+		if b {
+			return nil
+		}
+		return [][]byte{mth(d)}
+	}
+	k := largestPowerOfTwoLessThan(n)
+	if m <= k {
+		return append(subproof(m, d[:k], b), mth(d[k:]))
+	}
+	return append(subproof(m-k, d[k:], false), mth(d[:k]))
+}
+
+func consistencyProof(m, n int, d [][]byte) [][]byte {
+	return subproof(m, d, true)
+}
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte{byte(i), byte(i >> 8)}
+	}
+	return leaves
+}
+
+func TestVerifyConsistencyProofHonestGrowth(t *testing.T) {
+	const maxSize = 64
+	for n := 2; n <= maxSize; n++ {
+		leaves := testLeaves(n)
+		secondRoot := mth(leaves)
+		for m := 1; m < n; m++ {
+			firstRoot := mth(leaves[:m])
+			proof := consistencyProof(m, n, leaves)
+			if err := verifyConsistencyProof(uint64(m), uint64(n), firstRoot, secondRoot, proof); err != nil {
+				t.Fatalf("verifyConsistencyProof(%d, %d) failed on an honestly grown tree: %v", m, n, err)
+			}
+		}
+	}
+}
+
+func TestVerifyConsistencyProofDetectsForkedHistory(t *testing.T) {
+	const m, n = 3, 7
+	leaves := testLeaves(n)
+	firstRoot := mth(leaves[:m])
+	secondRoot := mth(leaves)
+	proof := consistencyProof(m, n, leaves)
+
+	tampered := make([][]byte, len(proof))
+	copy(tampered, proof)
+	tampered[0] = bytes.Repeat([]byte{0xFF}, len(tampered[0]))
+
+	if err := verifyConsistencyProof(m, n, firstRoot, secondRoot, tampered); err == nil {
+		t.Fatal("expected verifyConsistencyProof to reject a tampered proof, got nil error")
+	}
+}